@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mappingReloadInterval is how often a MappingHandler checks its file for
+// changes.
+const mappingReloadInterval = 10 * time.Second
+
+// PropertyTransform mutates a single field of a webhook's data before the
+// resulting event is dispatched.
+type PropertyTransform struct {
+	Field string `json:"field" yaml:"field"`
+	// Op is "rename", "drop" or "template".
+	Op       string `json:"op" yaml:"op"`
+	RenameTo string `json:"rename_to,omitempty" yaml:"rename_to,omitempty"`
+	// Template may reference other fields as {{field_name}}.
+	Template string `json:"template,omitempty" yaml:"template,omitempty"`
+}
+
+// Mapping describes how one Customer.io event type becomes an outgoing
+// event, replacing what used to be a hardcoded if/else chain.
+type Mapping struct {
+	SourceEvent string `json:"source_event" yaml:"source_event"`
+	TargetEvent string `json:"target_event,omitempty" yaml:"target_event,omitempty"`
+	// Action is "track", "identify", "drop" or "alias".
+	Action             string              `json:"action" yaml:"action"`
+	PropertyTransforms []PropertyTransform `json:"property_transforms,omitempty" yaml:"property_transforms,omitempty"`
+}
+
+// apply runs m's property transforms against data in place.
+func (m Mapping) apply(data map[string]interface{}) {
+	for _, t := range m.PropertyTransforms {
+		switch t.Op {
+		case "drop":
+			delete(data, t.Field)
+		case "rename":
+			if v, ok := data[t.Field]; ok {
+				delete(data, t.Field)
+				data[t.RenameTo] = v
+			}
+		case "template":
+			data[t.Field] = renderTemplate(t.Template, data)
+		}
+	}
+}
+
+func renderTemplate(tmpl string, data map[string]interface{}) string {
+	out := tmpl
+	for field, value := range data {
+		out = strings.ReplaceAll(out, "{{"+field+"}}", fmt.Sprintf("%v", value))
+	}
+	return out
+}
+
+// MappingConfig is the full mappings file.
+type MappingConfig struct {
+	Mappings []Mapping `json:"mappings" yaml:"mappings"`
+}
+
+func (c *MappingConfig) find(sourceEvent string) (Mapping, bool) {
+	for _, m := range c.Mappings {
+		if m.SourceEvent == sourceEvent {
+			return m, true
+		}
+	}
+	return Mapping{}, false
+}
+
+// defaultMappings reproduces the event-type mapping that used to be a
+// hardcoded if/else chain, so the server behaves the same when no mappings
+// file is configured.
+func defaultMappings() *MappingConfig {
+	return &MappingConfig{Mappings: []Mapping{
+		{SourceEvent: "customer_unsubscribed", TargetEvent: "Email - unsubscribed", Action: "track"},
+		{SourceEvent: "email_converted", Action: "drop"},
+		{SourceEvent: "email_drafted", Action: "drop"},
+		{SourceEvent: "email_dropped", Action: "drop"},
+		{SourceEvent: "email_delivered", Action: "drop"},
+		{SourceEvent: "email_bounced", TargetEvent: "Email - email failed", Action: "track"},
+		{SourceEvent: "email_failed", TargetEvent: "Email - email failed", Action: "track"},
+		{SourceEvent: "email_spammed", TargetEvent: "Email - email failed", Action: "track"},
+		{SourceEvent: "email_sent", TargetEvent: "Email - email sent", Action: "track"},
+		{SourceEvent: "email_opened", TargetEvent: "Email - opened email", Action: "track"},
+		{SourceEvent: "email_clicked", TargetEvent: "Email - clicked email", Action: "track"},
+	}}
+}
+
+// MappingHandler holds the live MappingConfig and hot-reloads it from disk
+// whenever the file's contents change, so marketing can add a new event
+// name without a redeploy.
+type MappingHandler struct {
+	path string
+
+	mu          sync.Mutex
+	fingerprint string
+
+	current atomic.Pointer[MappingConfig]
+}
+
+// NewMappingHandler loads the mappings file at path. An empty path falls
+// back to defaultMappings and disables hot-reload.
+func NewMappingHandler(path string) (*MappingHandler, error) {
+	h := &MappingHandler{path: path}
+	if path == "" {
+		h.current.Store(defaultMappings())
+		return h, nil
+	}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Get returns the currently active mapping config.
+func (h *MappingHandler) Get() *MappingConfig {
+	return h.current.Load()
+}
+
+func fingerprintOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func parseMappingFile(path string, data []byte) (*MappingConfig, error) {
+	config := &MappingConfig{}
+
+	var err error
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		err = yaml.Unmarshal(data, config)
+	} else {
+		err = json.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parseMappingFile: %v", err)
+	}
+	return config, nil
+}
+
+func (h *MappingHandler) reload() error {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("MappingHandler.reload: %v", err)
+	}
+	fp := fingerprintOf(data)
+
+	h.mu.Lock()
+	observed := h.fingerprint
+	h.mu.Unlock()
+
+	if observed == fp {
+		return nil
+	}
+
+	return h.DoLockedAction(observed, func() (*MappingConfig, error) {
+		return parseMappingFile(h.path, data)
+	}, fp)
+}
+
+// DoLockedAction swaps in the MappingConfig produced by action, but only if
+// fingerprint still matches the last fingerprint this handler observed.
+// That guards against two concurrent reloads completing out of order and
+// an older one clobbering a newer one.
+func (h *MappingHandler) DoLockedAction(fingerprint string, action func() (*MappingConfig, error), newFingerprint string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if fingerprint != h.fingerprint {
+		return nil
+	}
+
+	config, err := action()
+	if err != nil {
+		return err
+	}
+
+	h.current.Store(config)
+	h.fingerprint = newFingerprint
+	log.Printf("mappings reloaded from %s (fingerprint %s)", h.path, newFingerprint)
+	return nil
+}
+
+// Watch polls the mappings file for changes and hot-reloads it until the
+// process exits. It is meant to be started with `go handler.Watch()`.
+func (h *MappingHandler) Watch() {
+	ticker := time.NewTicker(mappingReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.reload(); err != nil {
+			log.Print(err)
+		}
+	}
+}
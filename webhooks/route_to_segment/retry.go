@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// retryBackoff is the exponential backoff schedule applied to a failed
+// delivery attempt. Once the schedule is exhausted the entry is
+// dead-lettered instead of being retried again.
+var retryBackoff = []time.Duration{
+	15 * time.Second,
+	1 * time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	12 * time.Hour,
+}
+
+// retryPollInterval is how often the worker checks the queue for due entries.
+const retryPollInterval = 15 * time.Second
+
+// RetryEntry is a single queued redelivery, persisted to disk so the queue
+// survives a restart.
+type RetryEntry struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"` // "webhook", "identify" or "track"
+	Env         string    `json:"env"`
+	RequestID   string    `json:"request_id"`
+	Body        []byte    `json:"body"`
+	AttemptNb   int       `json:"attempt_nb"`
+	NextRetryAt time.Time `json:"next_retry_at"`
+	LastError   string    `json:"last_error,omitempty"`
+	Dead        bool      `json:"dead"`
+	// IsTest marks a dry-run attempt: the worker exercises the retry/backoff
+	// bookkeeping for this entry without dispatching to real senders, which
+	// is useful for operators validating /retries behavior against
+	// production-shaped payloads.
+	IsTest bool `json:"is_test,omitempty"`
+}
+
+// RetryQueue is a bounded, on-disk queue of failed deliveries. A
+// background worker (Run) retries each entry on retryBackoff until it
+// succeeds or the schedule is exhausted, at which point the entry is kept
+// around as dead-lettered for operator inspection via /retries.
+type RetryQueue struct {
+	path     string
+	maxSize  int
+	mappings *MappingHandler
+	logger   *Logger
+
+	mu      sync.Mutex
+	entries []*RetryEntry
+}
+
+// NewRetryQueue loads any persisted entries from path. An empty path
+// disables persistence: the queue still works in-memory for the lifetime
+// of the process, which is convenient for tests and dry runs.
+func NewRetryQueue(path string, maxSize int, mappings *MappingHandler, logger *Logger) (*RetryQueue, error) {
+	q := &RetryQueue{path: path, maxSize: maxSize, mappings: mappings, logger: logger}
+	if path == "" {
+		return q, nil
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *RetryQueue) load() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("RetryQueue.load: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e RetryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("RetryQueue.load: skipping malformed entry: %v", err)
+			continue
+		}
+		q.entries = append(q.entries, &e)
+	}
+	return scanner.Err()
+}
+
+// persist rewrites the on-disk log from the in-memory entries. The queue
+// is small and low-throughput enough that a full rewrite per mutation is
+// simpler and safer than maintaining an append-only log with compaction.
+func (q *RetryQueue) persist() error {
+	if q.path == "" {
+		return nil
+	}
+
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("RetryQueue.persist: %v", err)
+	}
+
+	enc := json.NewEncoder(f)
+	for _, e := range q.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("RetryQueue.persist: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("RetryQueue.persist: %v", err)
+	}
+	return os.Rename(tmp, q.path)
+}
+
+func newRetryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Enqueue records a failed delivery for later retry. If the queue is at
+// maxSize, the oldest dead-lettered entry is dropped to make room; if none
+// are dead the event is dropped and logged loudly rather than growing
+// unbounded.
+func (q *RetryQueue) Enqueue(kind, env, requestID string, body []byte, cause error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxSize > 0 && len(q.entries) >= q.maxSize && !q.dropOldestDeadLocked() {
+		q.logger.Warn(requestID, "retry queue full (%d entries); dropping %s event for env %s: %v", q.maxSize, kind, env, cause)
+		return
+	}
+
+	q.entries = append(q.entries, &RetryEntry{
+		ID:          newRetryID(),
+		Kind:        kind,
+		Env:         env,
+		RequestID:   requestID,
+		Body:        append([]byte(nil), body...),
+		NextRetryAt: time.Now().Add(retryBackoff[0]),
+		LastError:   cause.Error(),
+	})
+	if err := q.persist(); err != nil {
+		q.logger.Error(requestID, "%v", err)
+	}
+}
+
+func (q *RetryQueue) dropOldestDeadLocked() bool {
+	for i, e := range q.entries {
+		if e.Dead {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Depth returns the number of entries currently queued, including
+// dead-lettered ones.
+func (q *RetryQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Run is the retry worker's main loop. It polls the queue for due entries
+// and redelivers them, applying retryBackoff on failure, until ctx's
+// process exits. It is meant to be started with `go retryQueue.Run(config)`.
+func (q *RetryQueue) Run(config *Config) {
+	ticker := time.NewTicker(retryPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		q.retryDue(config)
+	}
+}
+
+func (q *RetryQueue) retryDue(config *Config) {
+	q.mu.Lock()
+	due := make([]*RetryEntry, 0)
+	for _, e := range q.entries {
+		if !e.Dead && !e.NextRetryAt.After(time.Now()) {
+			due = append(due, e)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, e := range due {
+		err := q.deliver(config, e)
+
+		q.mu.Lock()
+		if err == nil {
+			q.removeLocked(e.ID)
+		} else {
+			e.AttemptNb++
+			e.LastError = err.Error()
+			if e.AttemptNb >= len(retryBackoff) {
+				e.Dead = true
+				q.logger.Error(e.RequestID, "event %s (%s/%s) dead-lettered after %d attempts: %v", e.ID, e.Kind, e.Env, e.AttemptNb, err)
+			} else {
+				e.NextRetryAt = time.Now().Add(retryBackoff[e.AttemptNb])
+			}
+		}
+		if perr := q.persist(); perr != nil {
+			log.Print(perr)
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *RetryQueue) deliver(config *Config, e *RetryEntry) error {
+	if e.IsTest {
+		q.logger.Info(e.RequestID, "kind=%s env=%s outcome=ok (dry run, not dispatched)", e.Kind, e.Env)
+		return nil
+	}
+	if e.Kind == "webhook" {
+		return deliverWebhookEvent(config, q.mappings, q.logger, e.Env, e.RequestID, e.Body)
+	}
+	return replayAction(e.Kind, config, q.logger, e.Env, e.RequestID, e.Body)
+}
+
+func (q *RetryQueue) removeLocked(id string) {
+	for i, e := range q.entries {
+		if e.ID == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *RetryQueue) find(id string) *RetryEntry {
+	for _, e := range q.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// handleAdmin serves GET /retries (queue depth + entries) and lets an
+// operator POST /retries?id=<id>&action=requeue|drop to manage a
+// dead-lettered entry. requeue accepts an optional &test=true to mark the
+// entry as a dry run: the worker exercises the retry bookkeeping without
+// dispatching it to real senders, so operators can validate the retry path
+// against a real payload without double-delivering it.
+func (q *RetryQueue) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if r.Method == http.MethodPost {
+		id := r.URL.Query().Get("id")
+		switch r.URL.Query().Get("action") {
+		case "requeue":
+			e := q.find(id)
+			if e == nil {
+				http.Error(w, fmt.Sprintf("no retry entry %#v", id), http.StatusNotFound)
+				return
+			}
+			e.Dead = false
+			e.IsTest = r.URL.Query().Get("test") == "true"
+			e.NextRetryAt = time.Now()
+		case "drop":
+			q.removeLocked(id)
+		default:
+			http.Error(w, "action must be requeue or drop", http.StatusBadRequest)
+			return
+		}
+		if err := q.persist(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"depth":   len(q.entries),
+		"entries": q.entries,
+	})
+}
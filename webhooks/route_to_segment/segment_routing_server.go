@@ -2,22 +2,56 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"time"
-
-	"github.com/segmentio/analytics-go"
 )
 
 type ConfigEnv struct {
-	SegmentWriteKey string `json:"segment_write_key"`
+	// Destinations lists where events for this environment are forwarded.
+	// Each one is dispatched to concurrently; see Sender.
+	Destinations            []Destination `json:"destinations"`
+	CustomerIOSigningSecret string        `json:"customerio_signing_secret"`
+	// SignatureToleranceSeconds bounds how old X-CIO-Timestamp may be before a
+	// request is rejected as stale. Defaults to defaultSignatureTolerance when zero.
+	SignatureToleranceSeconds int `json:"signature_tolerance_seconds"`
 }
 
 type Config struct {
 	Envs map[string]ConfigEnv `json:"environments"`
+
+	// RetryQueuePath is where failed deliveries are persisted for
+	// later retry. Retries are disabled when empty.
+	RetryQueuePath string `json:"retry_queue_path"`
+	// RetryQueueMaxSize bounds how many entries the retry queue may hold.
+	// 0 means unbounded.
+	RetryQueueMaxSize int `json:"retry_queue_max_size"`
+
+	// MappingsPath points at a JSON or YAML file (selected by extension)
+	// holding the event-type mappings. See MappingHandler. Falls back to
+	// defaultMappings when empty.
+	MappingsPath string `json:"mappings_path"`
+
+	// EventStreamBufferSize bounds how many recent events /events/stream and
+	// /events/sse replay to a newly-connected client. 0 uses
+	// defaultEventStreamBuffer.
+	EventStreamBufferSize int `json:"event_stream_buffer_size"`
+
+	// LogLevel is one of "debug", "info", "warn" or "error". Defaults to
+	// "info". Can be changed at runtime via POST /admin/loglevel or SIGHUP.
+	LogLevel string `json:"log_level"`
+
+	// AdminToken gates /admin/loglevel, /retries, /events/stream and
+	// /events/sse, all of which expose operational state or raw customer
+	// payloads. Requests must send it as the X-Admin-Token header. There is
+	// no default: an empty AdminToken disables these routes entirely rather
+	// than leaving them open.
+	AdminToken string `json:"admin_token"`
 }
 
 type Webhook struct {
@@ -29,17 +63,42 @@ type Webhook struct {
 	Data            map[string]interface{} `json:"data"`
 }
 
+// Event is the canonical representation of an outgoing event, shared by
+// every Sender regardless of destination. Its JSON shape mirrors Segment's
+// public track/identify call format, since that's what POSTs to
+// /webhook/identify and /webhook/track already look like on the wire.
+type Event struct {
+	Kind       string                 `json:"kind"`
+	UserID     string                 `json:"userId"`
+	Event      string                 `json:"event,omitempty"`
+	Traits     map[string]interface{} `json:"traits,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Context    map[string]interface{} `json:"context,omitempty"`
+	Timestamp  string                 `json:"timestamp,omitempty"`
+}
+
 type Action interface {
 	Unmarshal(data []byte) error
-	Send(client *analytics.Client) error
+	// Event returns the canonical form of the unmarshalled action, ready
+	// to hand to a Sender.
+	Event() *Event
+	// Kind identifies the action for the retry queue ("identify" or "track").
+	Kind() string
 }
 
 type Identify struct {
-	identify *analytics.Identify
+	event *Event
 }
 
 type Track struct {
-	track *analytics.Track
+	event *Event
+}
+
+// actionKinds maps a RetryEntry.Kind back to a fresh Action, so queued
+// identify/track payloads can be replayed after a restart.
+var actionKinds = map[string]func() Action{
+	"identify": func() Action { return &Identify{} },
+	"track":    func() Action { return &Track{} },
 }
 
 func (w *Webhook) EventSource() string {
@@ -60,17 +119,25 @@ func (w *Webhook) TimestampRFC3339() string {
 }
 
 func (i *Identify) Unmarshal(data []byte) error {
-	return json.Unmarshal(data, &i.identify)
+	return json.Unmarshal(data, &i.event)
 }
-func (i *Identify) Send(client *analytics.Client) error {
-	return client.Identify(i.identify)
+func (i *Identify) Event() *Event {
+	i.event.Kind = "identify"
+	return i.event
+}
+func (i *Identify) Kind() string {
+	return "identify"
 }
 
 func (i *Track) Unmarshal(data []byte) error {
-	return json.Unmarshal(data, &i.track)
+	return json.Unmarshal(data, &i.event)
+}
+func (i *Track) Event() *Event {
+	i.event.Kind = "track"
+	return i.event
 }
-func (i *Track) Send(client *analytics.Client) error {
-	return client.Track(i.track)
+func (i *Track) Kind() string {
+	return "track"
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -89,7 +156,9 @@ func loadConfig(path string) (*Config, error) {
 	return config, nil
 }
 
-func handle(action Action, config *Config, w http.ResponseWriter, r *http.Request) {
+func handle(action Action, config *Config, queue *RetryQueue, hub *EventHub, logger *Logger, w http.ResponseWriter, r *http.Request) {
+
+	requestID := requestIDFor(r)
 
 	query := r.URL.Query()
 
@@ -97,38 +166,165 @@ func handle(action Action, config *Config, w http.ResponseWriter, r *http.Reques
 	envConfig, ok := config.Envs[env]
 	if !ok {
 		msg := fmt.Sprintf("Environment %#v does not exist", env)
-		log.Print(msg)
+		logger.Warn(requestID, "%s", msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
-	buf := make([]byte, r.ContentLength)
-	r.Body.Read(buf)
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn(requestID, "failed to read request body env=%s: %v", env, err)
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
 
-	log.Println(string(buf))
+	logger.Debug(requestID, "%s payload env=%s body=%s", action.Kind(), env, buf)
+	hub.Publish(env, action.Kind(), buf)
 
 	if err := action.Unmarshal(buf); err != nil {
-		log.Println(err, r)
+		logger.Warn(requestID, "%s unmarshal failed env=%s: %v", action.Kind(), env, err)
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte("bad request"))
 		return
 	}
 
-	segment := analytics.New(envConfig.SegmentWriteKey)
+	event := action.Event()
+	if event.Context == nil {
+		event.Context = map[string]interface{}{}
+	}
+	event.Context["request_id"] = requestID
+
+	senders, err := buildSenders(envConfig.Destinations)
+	if err != nil {
+		logger.Error(requestID, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if err := action.Send(segment); err != nil {
-		msg := fmt.Sprintf("action.Send failed: %s", err)
-		log.Print(err)
+	if err := dispatch(senders, event); err != nil {
+		msg := fmt.Sprintf("dispatch failed: %s", err)
+		logger.Error(requestID, "kind=%s user=%s env=%s outcome=error: %v", action.Kind(), event.UserID, env, err)
+		queue.Enqueue(action.Kind(), env, requestID, buf, err)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
 
-	log.Println("ok", r)
+	logger.Info(requestID, "kind=%s user=%s env=%s outcome=ok", action.Kind(), event.UserID, env)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
+// replayAction redelivers a queued identify/track payload. It is the retry
+// path's counterpart to handle(), with the HTTP plumbing stripped out.
+func replayAction(kind string, config *Config, logger *Logger, env, requestID string, body []byte) error {
+	newAction, ok := actionKinds[kind]
+	if !ok {
+		return fmt.Errorf("replayAction: unknown kind %#v", kind)
+	}
+	envConfig, ok := config.Envs[env]
+	if !ok {
+		return fmt.Errorf("replayAction: environment %#v does not exist", env)
+	}
+
+	action := newAction()
+	if err := action.Unmarshal(body); err != nil {
+		return fmt.Errorf("replayAction: %v", err)
+	}
+
+	event := action.Event()
+	if event.Context == nil {
+		event.Context = map[string]interface{}{}
+	}
+	event.Context["request_id"] = requestID
+
+	senders, err := buildSenders(envConfig.Destinations)
+	if err != nil {
+		return err
+	}
+	return dispatch(senders, event)
+}
+
+// BadWebhookError marks a deliverWebhookEvent failure as the caller's fault
+// (malformed payload) rather than a transient delivery failure, so
+// the handler neither retries it nor re-enqueues it.
+type BadWebhookError struct {
+	msg string
+}
+
+func (e *BadWebhookError) Error() string {
+	return e.msg
+}
+
+// deliverWebhookEvent applies the configured event-type mapping and
+// forwards a Customer.io webhook payload to every configured destination.
+// It is shared by the /webhook handler and the retry worker so a queued
+// "webhook" entry is replayed with identical logic.
+func deliverWebhookEvent(config *Config, mappings *MappingHandler, logger *Logger, env, requestID string, buf []byte) error {
+	envConfig, ok := config.Envs[env]
+	if !ok {
+		return fmt.Errorf("deliverWebhookEvent: environment %#v does not exist", env)
+	}
+
+	var webhook *Webhook
+	if err := json.Unmarshal(buf, &webhook); err != nil {
+		return &BadWebhookError{fmt.Sprintf("deliverWebhookEvent: %v", err)}
+	}
+
+	delete(webhook.Data, "variables")
+
+	customerID, ok := webhook.Data["customer_id"].(string)
+	if !ok {
+		return &BadWebhookError{"deliverWebhookEvent: data.customer_id is missing or not a string"}
+	}
+
+	mapping, ok := mappings.Get().find(webhook.EventType)
+	if !ok {
+		mapping = Mapping{SourceEvent: webhook.EventType, TargetEvent: webhook.EventType, Action: "track"}
+	}
+	if mapping.Action == "drop" {
+		logger.Info(requestID, "event_type=%s user=%s env=%s outcome=dropped", webhook.EventType, customerID, env)
+		return nil
+	}
+	mapping.apply(webhook.Data)
+
+	senders, err := buildSenders(envConfig.Destinations)
+	if err != nil {
+		return err
+	}
+
+	event := &Event{
+		UserID:    customerID,
+		Timestamp: webhook.TimestampRFC3339(),
+		Context:   map[string]interface{}{"event_id": webhook.EventID, "request_id": requestID},
+	}
+
+	switch mapping.Action {
+	case "identify":
+		event.Kind = "identify"
+		event.Traits = webhook.Data
+	case "alias":
+		event.Kind = "alias"
+		previousID, _ := webhook.Data["previous_id"].(string)
+		event.Traits = map[string]interface{}{"previous_id": previousID}
+	default: // "track"
+		eventType := mapping.TargetEvent
+		if eventType == "" {
+			eventType = webhook.EventType
+		}
+		event.Kind = "track"
+		event.Event = eventType
+		event.Properties = webhook.Data
+	}
+
+	if err := dispatch(senders, event); err != nil {
+		logger.Error(requestID, "event_type=%s user=%s env=%s outcome=error: %v", webhook.EventType, customerID, env, err)
+		return err
+	}
+	logger.Info(requestID, "event_type=%s user=%s env=%s outcome=ok", webhook.EventType, customerID, env)
+	return nil
+}
+
 func main() {
 
 	configPath := flag.String("config", "./config.json", "Path to the config file")
@@ -139,114 +335,85 @@ func main() {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+	initialLevel, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := NewLogger(initialLevel)
+	go logger.watchSIGHUP(*configPath)
+
+	mappings, err := NewMappingHandler(config.MappingsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go mappings.Watch()
+
+	retryQueue, err := NewRetryQueue(config.RetryQueuePath, config.RetryQueueMaxSize, mappings, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go retryQueue.Run(config)
+
+	hub := NewEventHub(config.EventStreamBufferSize)
+
+	http.HandleFunc("/webhook", requireValidSignature(config, logger, func(w http.ResponseWriter, r *http.Request) {
+
+		requestID := requestIDFor(r)
 
 		query := r.URL.Query()
 
 		env := query.Get("env")
-		envConfig, ok := config.Envs[env]
-		if !ok {
+		if _, ok := config.Envs[env]; !ok {
 			msg := fmt.Sprintf("Environment %#v does not exist", env)
-			log.Print(msg)
+			logger.Warn(requestID, "%s", msg)
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
 
-		buf := make([]byte, r.ContentLength)
-		r.Body.Read(buf)
-
-		log.Println(string(buf))
-
-		var webhook *Webhook
-		err := json.Unmarshal(buf, &webhook)
-
+		buf, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Println(err, r)
-			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte("bad request"))
+			logger.Warn(requestID, "failed to read request body env=%s: %v", env, err)
+			http.Error(w, "failed to read body", http.StatusBadRequest)
 			return
 		}
 
-		delete(webhook.Data, "variables")
-
-		if webhook.Data["customer_id"] == nil {
-			msg := "data.customer_id is nil"
-			log.Print(err)
-			http.Error(w, msg, http.StatusNotAcceptable)
-			return
+		var topic struct {
+			EventType string `json:"event_type"`
 		}
-		customerID := webhook.Data["customer_id"].(string)
-
-		var eventType, webhookEventType string
-        webhookEventType = webhook.EventType
-		eventType = webhookEventType
-         
-		if webhookEventType == "customer_unsubscribed" {
-			eventType = "Email - unsubscribed"
-		} else if webhookEventType == "email_converted" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
-			return
-		} else if webhookEventType == "email_drafted" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
-			return
-		} else if webhookEventType == "email_dropped" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
-			return
-		} else if webhookEventType == "email_delivered" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
-			return
-		} else if webhookEventType == "email_bounced" {
-			eventType = "Email - email failed"
-		} else if webhookEventType == "email_failed" {
-			eventType = "Email - email failed"
-		} else if webhookEventType == "email_spammed" {
-			eventType = "Email - email failed"
-		} else if webhookEventType == "email_sent" {
-			eventType = "Email - email sent"
-		} else if webhookEventType == "email_opened" {
-			eventType = "Email - opened email"
-		} else if webhookEventType == "email_clicked" {
-			eventType = "Email - clicked email"
-		} 
-
-		segment := analytics.New(envConfig.SegmentWriteKey)
-
-		err = segment.Track(&analytics.Track{
-			UserId:     customerID,
-			Event:      eventType,
-			Properties: webhook.Data,
-			Context: map[string]interface{}{
-				"event_id": webhook.EventID,
-			},
-			Message: analytics.Message{
-				Timestamp: webhook.TimestampRFC3339(),
-			},
-		})
-
-		if err != nil {
-			msg := fmt.Sprintf("segment.Track failed: %s", err)
-			log.Print(err)
+		json.Unmarshal(buf, &topic)
+		logger.Debug(requestID, "webhook payload env=%s event_type=%s body=%s", env, topic.EventType, buf)
+		hub.Publish(env, topic.EventType, buf)
+
+		if err := deliverWebhookEvent(config, mappings, logger, env, requestID, buf); err != nil {
+			var bad *BadWebhookError
+			if errors.As(err, &bad) {
+				logger.Warn(requestID, "%v", err)
+				w.WriteHeader(http.StatusNotAcceptable)
+				w.Write([]byte("bad request"))
+				return
+			}
+			msg := fmt.Sprintf("deliverWebhookEvent failed: %s", err)
+			retryQueue.Enqueue("webhook", env, requestID, buf, err)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
 
-		log.Println("ok", r)
-
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
-	})
+	}))
+
+	http.HandleFunc("/webhook/identify", requireValidSignature(config, logger, func(w http.ResponseWriter, r *http.Request) {
+		handle(&Identify{}, config, retryQueue, hub, logger, w, r)
+	}))
 
-	http.HandleFunc("/webhook/identify", func(w http.ResponseWriter, r *http.Request) {
-		handle(&Identify{}, config, w, r)
-	})
+	http.HandleFunc("/webhook/track", requireValidSignature(config, logger, func(w http.ResponseWriter, r *http.Request) {
+		handle(&Track{}, config, retryQueue, hub, logger, w, r)
+	}))
 
-	http.HandleFunc("/webhook/track", func(w http.ResponseWriter, r *http.Request) {
-		handle(&Track{}, config, w, r)
-	})
+	http.HandleFunc("/retries", requireAdminToken(config, logger, retryQueue.handleAdmin))
+	http.HandleFunc("/events/stream", requireAdminToken(config, logger, hub.handleWebSocket))
+	http.HandleFunc("/events/sse", requireAdminToken(config, logger, hub.handleSSE))
+	http.HandleFunc("/admin/loglevel", requireAdminToken(config, logger, logger.handleLogLevel))
 
 	log.Print("Listening on :8080 for incoming webhooks to forward to segment.com")
 	log.Fatal(http.ListenAndServe(":8080", nil))
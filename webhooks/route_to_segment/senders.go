@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/analytics-go"
+)
+
+// Destination configures a single place an Event should be forwarded to.
+// Type selects which Sender implementation is built; the remaining fields
+// are interpreted according to Type and otherwise ignored.
+type Destination struct {
+	Type string `json:"type"` // "segment", "webhook", "slack" or "smtp"
+
+	// segment
+	WriteKey string `json:"write_key,omitempty"`
+
+	// webhook, slack
+	URL         string            `json:"url,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	BearerToken string            `json:"bearer_token,omitempty"`
+
+	// smtp
+	SMTPAddr string   `json:"smtp_addr,omitempty"` // host:port
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
+// Sender delivers an Event to one destination.
+type Sender interface {
+	Send(ctx context.Context, event *Event) error
+}
+
+// httpClient is shared by the HTTP-based senders (webhook, Slack).
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// smtpTimeout bounds how long SMTPSender.Send may spend dialing and talking
+// to the server, matching httpClient's timeout for the HTTP-based senders.
+const smtpTimeout = 10 * time.Second
+
+// buildSenders turns a []Destination config into ready-to-use Senders.
+func buildSenders(destinations []Destination) ([]Sender, error) {
+	senders := make([]Sender, 0, len(destinations))
+	for _, d := range destinations {
+		switch d.Type {
+		case "segment":
+			senders = append(senders, &SegmentSender{WriteKey: d.WriteKey})
+		case "webhook":
+			senders = append(senders, &GenericWebhookSender{URL: d.URL, Headers: d.Headers, BearerToken: d.BearerToken})
+		case "slack":
+			senders = append(senders, &SlackSender{URL: d.URL})
+		case "smtp":
+			senders = append(senders, &SMTPSender{
+				Addr:     d.SMTPAddr,
+				From:     d.From,
+				To:       d.To,
+				Username: d.Username,
+				Password: d.Password,
+			})
+		default:
+			return nil, fmt.Errorf("buildSenders: unknown destination type %#v", d.Type)
+		}
+	}
+	return senders, nil
+}
+
+// dispatch delivers event to every sender concurrently, waits for all of
+// them to finish, and aggregates any failures into a single error.
+func dispatch(senders []Sender, event *Event) error {
+	if len(senders) == 0 {
+		return fmt.Errorf("dispatch: no destinations configured")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(senders))
+	for i, s := range senders {
+		wg.Add(1)
+		go func(i int, s Sender) {
+			defer wg.Done()
+			errs[i] = s.Send(context.Background(), event)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("dispatch: %s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// SegmentSender forwards an Event to Segment as a Track or Identify call.
+type SegmentSender struct {
+	WriteKey string
+}
+
+func (s *SegmentSender) Send(ctx context.Context, event *Event) error {
+	client := analytics.New(s.WriteKey)
+	defer client.Close()
+
+	var timestamp time.Time
+	if event.Timestamp != "" {
+		timestamp, _ = time.Parse(time.RFC3339, event.Timestamp)
+	}
+	segCtx := &analytics.Context{Extra: event.Context}
+
+	switch event.Kind {
+	case "identify":
+		return client.Enqueue(analytics.Identify{
+			UserId:    event.UserID,
+			Traits:    analytics.Traits(event.Traits),
+			Context:   segCtx,
+			Timestamp: timestamp,
+		})
+	case "alias":
+		previousID, _ := event.Traits["previous_id"].(string)
+		return client.Enqueue(analytics.Alias{
+			UserId:     event.UserID,
+			PreviousId: previousID,
+			Context:    segCtx,
+			Timestamp:  timestamp,
+		})
+	default:
+		return client.Enqueue(analytics.Track{
+			UserId:     event.UserID,
+			Event:      event.Event,
+			Properties: analytics.Properties(event.Properties),
+			Context:    segCtx,
+			Timestamp:  timestamp,
+		})
+	}
+}
+
+// GenericWebhookSender POSTs the Event, verbatim as JSON, to URL.
+type GenericWebhookSender struct {
+	URL         string
+	Headers     map[string]string
+	BearerToken string
+}
+
+func (s *GenericWebhookSender) Send(ctx context.Context, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("GenericWebhookSender: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("GenericWebhookSender: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("GenericWebhookSender: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("GenericWebhookSender: %s returned %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// SlackSender posts a short summary of the Event to a Slack incoming webhook.
+type SlackSender struct {
+	URL string
+}
+
+func (s *SlackSender) Send(ctx context.Context, event *Event) error {
+	text := fmt.Sprintf("*%s* for `%s`", event.Event, event.UserID)
+	if event.Kind == "identify" {
+		text = fmt.Sprintf("identify for `%s`", event.UserID)
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("SlackSender: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("SlackSender: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("SlackSender: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SlackSender: %s returned %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// SMTPSender emails the Event as its own recipient list, using STARTTLS
+// when the server advertises support for it.
+type SMTPSender struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, event *Event) error {
+	body, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+
+	subject := fmt.Sprintf("[%s] %s", event.Kind, event.Event)
+	msg := fmt.Sprintf("Subject: %s\r\nTo: %s\r\n\r\n%s\r\n", subject, strings.Join(s.To, ", "), body)
+
+	host := s.Addr
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, smtpTimeout)
+	if err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("SMTPSender: StartTLS: %v", err)
+		}
+	}
+
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("SMTPSender: Auth: %v", err)
+		}
+	}
+
+	if err := c.Mail(s.From); err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("SMTPSender: %v", err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+
+	return c.Quit()
+}
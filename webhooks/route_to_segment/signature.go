@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultSignatureTolerance is how old an X-CIO-Timestamp may be before the
+// request is rejected, when ConfigEnv.SignatureToleranceSeconds is unset.
+const defaultSignatureTolerance = 5 * time.Minute
+
+// verifySignature checks that sig (from X-CIO-Signature) matches
+// HMAC-SHA256(secret, timestamp + ":" + body) in hex, using a constant-time
+// comparison to avoid leaking timing information about the secret.
+func verifySignature(secret, timestamp string, body []byte, sig string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + ":"))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// signatureTolerance returns how old an event's X-CIO-Timestamp may be before
+// it is rejected for the given environment.
+func (e ConfigEnv) signatureTolerance() time.Duration {
+	if e.SignatureToleranceSeconds <= 0 {
+		return defaultSignatureTolerance
+	}
+	return time.Duration(e.SignatureToleranceSeconds) * time.Second
+}
+
+// requireValidSignature wraps next so that requests must carry a valid
+// X-CIO-Signature/X-CIO-Timestamp pair for the request's ?env= before
+// reaching Customer.io's forwarding logic. The request body is read and
+// restored onto r.Body so downstream handlers can still consume it. The
+// request's correlation id is resolved here and stamped onto X-Request-Id
+// so every handler downstream of this middleware logs under the same id.
+func requireValidSignature(config *Config, logger *Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFor(r)
+		r.Header.Set("X-Request-Id", requestID)
+
+		env := r.URL.Query().Get("env")
+		envConfig, ok := config.Envs[env]
+		if !ok {
+			msg := fmt.Sprintf("Environment %#v does not exist", env)
+			logger.Warn(requestID, "%s", msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Warn(requestID, "failed to read request body: %v", err)
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+
+		timestamp := r.Header.Get("X-CIO-Timestamp")
+		sig := r.Header.Get("X-CIO-Signature")
+		if timestamp == "" || sig == "" {
+			logger.Warn(requestID, "webhook rejected: missing X-CIO-Timestamp/X-CIO-Signature")
+			http.Error(w, "missing signature", http.StatusUnauthorized)
+			return
+		}
+
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			logger.Warn(requestID, "webhook rejected: invalid X-CIO-Timestamp %#v", timestamp)
+			http.Error(w, "invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+		if age := time.Since(time.Unix(ts, 0)); age < 0 || age > envConfig.signatureTolerance() {
+			logger.Warn(requestID, "webhook rejected: X-CIO-Timestamp %s outside tolerance", timestamp)
+			http.Error(w, "stale timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		if !verifySignature(envConfig.CustomerIOSigningSecret, timestamp, buf, sig) {
+			logger.Warn(requestID, "webhook rejected: signature mismatch")
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireAdminToken wraps next so that admin/operational routes (loglevel,
+// retries, event streams) require the X-Admin-Token header to match
+// config.AdminToken, using a constant-time comparison. These routes expose
+// raw customer payloads and can alter logging verbosity, so an empty
+// AdminToken disables the route entirely rather than leaving it open.
+func requireAdminToken(config *Config, logger *Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFor(r)
+		r.Header.Set("X-Request-Id", requestID)
+
+		if config.AdminToken == "" {
+			logger.Warn(requestID, "admin route rejected: no admin_token configured")
+			http.Error(w, "admin routes are disabled", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get("X-Admin-Token")
+		if !hmac.Equal([]byte(token), []byte(config.AdminToken)) {
+			logger.Warn(requestID, "admin route rejected: invalid or missing X-Admin-Token")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
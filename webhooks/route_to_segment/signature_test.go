@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + ":"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"event_type":"test"}`)
+	sig := sign("s3cr3t", "12345", body)
+
+	if !verifySignature("s3cr3t", "12345", body, sig) {
+		t.Fatal("expected matching signature to verify")
+	}
+	if verifySignature("wrong", "12345", body, sig) {
+		t.Fatal("expected signature verification to fail with the wrong secret")
+	}
+	if verifySignature("s3cr3t", "12345", []byte(`{"event_type":"tampered"}`), sig) {
+		t.Fatal("expected signature verification to fail against a tampered body")
+	}
+}
+
+func TestSignatureTolerance(t *testing.T) {
+	if got := (ConfigEnv{}).signatureTolerance(); got != defaultSignatureTolerance {
+		t.Fatalf("signatureTolerance() = %v, want default %v", got, defaultSignatureTolerance)
+	}
+	if got := (ConfigEnv{SignatureToleranceSeconds: 30}).signatureTolerance(); got != 30*time.Second {
+		t.Fatalf("signatureTolerance() = %v, want 30s", got)
+	}
+}
+
+func TestRequireValidSignature(t *testing.T) {
+	const secret = "s3cr3t"
+	config := &Config{Envs: map[string]ConfigEnv{"prod": {CustomerIOSigningSecret: secret}}}
+	logger := NewLogger(LogLevelError)
+
+	var gotBody []byte
+	next := func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}
+	handler := requireValidSignature(config, logger, next)
+
+	newRequest := func(env string, body []byte, timestamp, sig string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/webhook?env="+env, strings.NewReader(string(body)))
+		if timestamp != "" {
+			req.Header.Set("X-CIO-Timestamp", timestamp)
+		}
+		if sig != "" {
+			req.Header.Set("X-CIO-Signature", sig)
+		}
+		return req
+	}
+
+	t.Run("valid signature passes through and restores the body", func(t *testing.T) {
+		body := []byte(`{"event_type":"test"}`)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req := newRequest("prod", body, ts, sign(secret, ts, body))
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		if string(gotBody) != string(body) {
+			t.Fatalf("body forwarded to next = %q, want %q", gotBody, body)
+		}
+	})
+
+	t.Run("unknown env is rejected", func(t *testing.T) {
+		req := newRequest("nope", nil, "", "")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", rec.Code)
+		}
+	})
+
+	t.Run("missing signature headers are rejected", func(t *testing.T) {
+		req := newRequest("prod", []byte(`{}`), "", "")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	})
+
+	t.Run("invalid timestamp is rejected", func(t *testing.T) {
+		req := newRequest("prod", []byte(`{}`), "not-a-number", "deadbeef")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	})
+
+	t.Run("stale timestamp is rejected", func(t *testing.T) {
+		body := []byte(`{}`)
+		ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		req := newRequest("prod", body, ts, sign(secret, ts, body))
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	})
+
+	t.Run("signature mismatch is rejected", func(t *testing.T) {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req := newRequest("prod", []byte(`{}`), ts, "0000000000000000000000000000000000000000000000000000000000000000")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	})
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	logger := NewLogger(LogLevelError)
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	t.Run("disabled when AdminToken is unset", func(t *testing.T) {
+		handler := requireAdminToken(&Config{}, logger, next)
+		req := httptest.NewRequest(http.MethodGet, "/admin/loglevel", nil)
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want 403", rec.Code)
+		}
+	})
+
+	t.Run("rejects a missing or wrong token", func(t *testing.T) {
+		handler := requireAdminToken(&Config{AdminToken: "t0ken"}, logger, next)
+		req := httptest.NewRequest(http.MethodGet, "/admin/loglevel", nil)
+		req.Header.Set("X-Admin-Token", "wrong")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	})
+
+	t.Run("accepts the configured token", func(t *testing.T) {
+		handler := requireAdminToken(&Config{AdminToken: "t0ken"}, logger, next)
+		req := httptest.NewRequest(http.MethodGet, "/admin/loglevel", nil)
+		req.Header.Set("X-Admin-Token", "t0ken")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	})
+}
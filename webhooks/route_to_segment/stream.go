@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultEventStreamBuffer is how many recent events a newly-connected
+// /events/stream or /events/sse client is replayed, when
+// Config.EventStreamBufferSize is unset.
+const defaultEventStreamBuffer = 100
+
+// EventEnvelope wraps a raw webhook payload with enough metadata for a
+// subscriber to filter by topic without having to inspect message itself,
+// which path-based routing alone can't give you once a single stream
+// carries several event types.
+type EventEnvelope struct {
+	ID      string          `json:"id"`
+	Topic   string          `json:"topic"`
+	Env     string          `json:"env"`
+	Message json.RawMessage `json:"message"`
+}
+
+// eventSubscriber is one connected /events/stream or /events/sse client.
+type eventSubscriber struct {
+	// topics is nil/empty to mean "subscribed to everything".
+	topics map[string]bool
+	ch     chan *EventEnvelope
+}
+
+func (s *eventSubscriber) wants(topic string) bool {
+	if len(s.topics) == 0 {
+		return true
+	}
+	return s.topics[topic]
+}
+
+// EventHub fans every received webhook out to connected debug-stream
+// subscribers, keeping a ring buffer of recent events so a client that
+// just connected can replay recent activity instead of starting blind.
+type EventHub struct {
+	ringSize int
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	ring        []*EventEnvelope
+}
+
+func NewEventHub(ringSize int) *EventHub {
+	if ringSize <= 0 {
+		ringSize = defaultEventStreamBuffer
+	}
+	return &EventHub{
+		ringSize:    ringSize,
+		subscribers: map[*eventSubscriber]bool{},
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publish fans a raw webhook payload out to every subscriber interested in
+// topic, and appends it to the ring buffer.
+func (h *EventHub) Publish(env, topic string, raw []byte) {
+	envelope := &EventEnvelope{
+		ID:      newEventID(),
+		Topic:   topic,
+		Env:     env,
+		Message: json.RawMessage(append([]byte(nil), raw...)),
+	}
+
+	h.mu.Lock()
+	h.ring = append(h.ring, envelope)
+	if len(h.ring) > h.ringSize {
+		h.ring = h.ring[len(h.ring)-h.ringSize:]
+	}
+	subs := make([]*eventSubscriber, 0, len(h.subscribers))
+	for s := range h.subscribers {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range subs {
+		if !s.wants(topic) {
+			continue
+		}
+		select {
+		case s.ch <- envelope:
+		default:
+			// Slow subscriber; drop rather than block the publisher.
+		}
+	}
+}
+
+// subscribe registers a new subscriber for topics (nil/empty means every
+// topic) and replays the ring buffer to it before returning.
+func (h *EventHub) subscribe(topics []string) *eventSubscriber {
+	s := &eventSubscriber{ch: make(chan *EventEnvelope, 64)}
+	if len(topics) > 0 {
+		s.topics = make(map[string]bool, len(topics))
+		for _, t := range topics {
+			s.topics[strings.TrimSpace(t)] = true
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = true
+	for _, e := range h.ring {
+		if s.wants(e.Topic) {
+			select {
+			case s.ch <- e:
+			default:
+			}
+		}
+	}
+	return s
+}
+
+func (h *EventHub) unsubscribe(s *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.ch)
+	}
+}
+
+func parseTopicFilter(r *http.Request) []string {
+	q := r.URL.Query().Get("topic")
+	if q == "" {
+		return nil
+	}
+	return strings.Split(q, ",")
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// This is a local debugging tool, not a production API; any origin
+	// may open a stream.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleWebSocket serves /events/stream.
+func (h *EventHub) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.subscribe(parseTopicFilter(r))
+	defer h.unsubscribe(sub)
+
+	for envelope := range sub.ch {
+		if err := conn.WriteJSON(envelope); err != nil {
+			return
+		}
+	}
+}
+
+// handleSSE serves /events/sse.
+func (h *EventHub) handleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.subscribe(parseTopicFilter(r))
+	defer h.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case envelope, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(envelope)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}